@@ -0,0 +1,153 @@
+package osl
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// The ioctl-based ethtool feature protocol used here mirrors what the
+// `ethtool -K` CLI does under the hood: look up the ETH_SS_FEATURES string
+// set to find each named feature's bit index, then flip that bit in an
+// ETHTOOL_SFEATURES request. See linux/ethtool.h for the wire format.
+const (
+	ethtoolGStringSet   = 0x0000001b
+	ethtoolGFeatures    = 0x0000003a
+	ethtoolSFeatures    = 0x0000003b
+	ethStringLen        = 32
+	ethSSFeatures       = 4
+	featureBitsPerBlock = 32
+)
+
+type ethtoolGStrings struct {
+	cmd       uint32
+	stringSet uint32
+	length    uint32
+	data      [512 * ethStringLen]byte
+}
+
+type ethtoolSetFeaturesBlock struct {
+	valid     uint32
+	requested uint32
+}
+
+type ethtoolSFeaturesReq struct {
+	cmd    uint32
+	size   uint32
+	blocks [8]ethtoolSetFeaturesBlock
+}
+
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+}
+
+// setInterfaceOffloadsViaEthtool toggles named hardware offload features on
+// ifaceName inside the network namespace at nsPath. Names are matched
+// exactly against the ETH_SS_FEATURES strings (e.g.
+// "tx-checksum-ip-generic", "tx-tcp-segmentation",
+// "tx-generic-segmentation", "rx-gro"); ethtool's short aliases such as
+// "tso", "gso" and "gro" are not in that set and are rejected as
+// unsupported. Unlike the netlink calls elsewhere in
+// this package, ethtool ioctls aren't addressable through a
+// namespace-bound *netlink.Handle, so this actually switches the calling
+// thread into the namespace for the duration of the call.
+func setInterfaceOffloadsViaEthtool(nsPath, ifaceName string, offloads map[string]bool) error {
+	if len(offloads) == 0 {
+		return nil
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNs, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer origNs.Close()
+
+	targetNs, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return fmt.Errorf("failed to get network namespace %q: %v", nsPath, err)
+	}
+	defer targetNs.Close()
+
+	if err := netns.Set(targetNs); err != nil {
+		return fmt.Errorf("failed to enter network namespace %q: %v", nsPath, err)
+	}
+	defer netns.Set(origNs)
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open ethtool socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	names, err := featureStringSet(fd, ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to read feature string set for %q: %v", ifaceName, err)
+	}
+
+	var req ethtoolSFeaturesReq
+	req.cmd = ethtoolSFeatures
+	req.size = (uint32(len(names)) + featureBitsPerBlock - 1) / featureBitsPerBlock
+
+	applied := make(map[string]bool, len(offloads))
+	for idx, name := range names {
+		enable, ok := offloads[name]
+		if !ok {
+			continue
+		}
+		block, bit := idx/featureBitsPerBlock, uint32(idx%featureBitsPerBlock)
+		req.blocks[block].valid |= 1 << bit
+		if enable {
+			req.blocks[block].requested |= 1 << bit
+		}
+		applied[name] = true
+	}
+	for name := range offloads {
+		if !applied[name] {
+			return fmt.Errorf("interface %q does not support offload feature %q", ifaceName, name)
+		}
+	}
+
+	return ethtoolIoctl(fd, ifaceName, unsafe.Pointer(&req))
+}
+
+// featureStringSet returns the ETH_SS_FEATURES string set for ifaceName, in
+// feature-bit-index order.
+func featureStringSet(fd int, ifaceName string) ([]string, error) {
+	var gs ethtoolGStrings
+	gs.cmd = ethtoolGStringSet
+	gs.stringSet = ethSSFeatures
+
+	if err := ethtoolIoctl(fd, ifaceName, unsafe.Pointer(&gs)); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, gs.length)
+	for idx := uint32(0); idx < gs.length; idx++ {
+		raw := gs.data[idx*ethStringLen : (idx+1)*ethStringLen]
+		end := 0
+		for end < len(raw) && raw[end] != 0 {
+			end++
+		}
+		names = append(names, string(raw[:end]))
+	}
+	return names, nil
+}
+
+func ethtoolIoctl(fd int, ifaceName string, data unsafe.Pointer) error {
+	var ifr ifreqData
+	copy(ifr.name[:], ifaceName)
+	ifr.data = data
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package osl
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -12,8 +15,23 @@ import (
 	"github.com/docker/docker/libnetwork/types"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
 )
 
+// linkWaitTimeout bounds how long waitForLinkEvent blocks on a netlink
+// subscription before giving up and letting the caller fall back to a
+// direct lookup.
+const linkWaitTimeout = 2 * time.Second
+
+// tracer is used to instrument the interface lifecycle (AddInterface,
+// Remove and the netlink calls in between) so slow container starts can be
+// traced down to a specific netlink call.
+var tracer = otel.Tracer("libnetwork/osl")
+
 // nwIface represents the settings and identity of a network device.
 // It is used as a return type for Network.Link, and it is common practice
 // for the caller to use this information when moving interface SrcName from
@@ -28,9 +46,314 @@ type nwIface struct {
 	address     *net.IPNet
 	addressIPv6 *net.IPNet
 	llAddrs     []*net.IPNet
-	routes      []*net.IPNet
+	routes      []RouteSpec
 	bridge      bool
 	ns          *networkNamespace
+
+	// sriovPFName and sriovVFIndex identify the SR-IOV virtual function this
+	// interface was carved out of, if any. sriovInitNsPath names the
+	// namespace the VF should be returned to on Remove, and sriovInitNs is
+	// the handle resolved from it once the interface has been added.
+	// sriovVFVlan is an optional VLAN to program on the VF before it moves.
+	sriovPFName     string
+	sriovVFIndex    int
+	sriovVFVlan     int
+	sriovInitNsPath string
+	sriovInitNs     netns.NsHandle
+
+	// childLinkKind, when non-empty, marks this interface as a macvlan,
+	// macvtap or ipvlan link that AddInterface creates on the host off of
+	// childLinkParent (a host interface) and then moves into the sandbox,
+	// instead of moving in an existing link named srcName. Exactly one of macvlanMode/macvtapMode/ipvlanMode is
+	// meaningful, depending on childLinkKind. childLinkMTU is applied to the
+	// child link at creation time.
+	childLinkKind   string
+	childLinkParent string
+	childLinkMTU    int
+	macvlanMode     netlink.MacvlanMode
+	macvtapMode     netlink.MacvtapMode
+	ipvlanMode      netlink.IPVlanMode
+
+	// mtu, txQLen and offloads are applied to the interface once it is in
+	// its final namespace, before it is brought up. A zero mtu/txQLen
+	// leaves the kernel/parent default in place; a nil offloads leaves
+	// hardware offload features untouched.
+	mtu      int
+	txQLen   int
+	offloads map[string]bool
+}
+
+// IfaceOption is a function option type to set interface options. An option
+// that rejects its input returns an error wrapped in IfaceOptionError so
+// that AddInterface can report every invalid option at once instead of just
+// the first one it happens to apply.
+type IfaceOption func(i *nwIface) error
+
+// IfaceOptionError is returned by a failing IfaceOption, with the name of
+// the option attached for context. Use AsIfaceOptionErrors to recover the
+// individual errors from the aggregate error AddInterface returns.
+type IfaceOptionError struct {
+	Option string
+	Err    error
+}
+
+func (e IfaceOptionError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Option, e.Err)
+}
+
+func (e IfaceOptionError) Unwrap() error {
+	return e.Err
+}
+
+// AsIfaceOptionErrors walks err (which may be a single error, or an
+// errors.Join aggregate as returned by AddInterface) and returns every
+// IfaceOptionError it finds, so callers can surface misconfigured options
+// individually rather than as one opaque joined message.
+func AsIfaceOptionErrors(err error) []IfaceOptionError {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var out []IfaceOptionError
+		for _, sub := range joined.Unwrap() {
+			out = append(out, AsIfaceOptionErrors(sub)...)
+		}
+		return out
+	}
+	var optErr IfaceOptionError
+	if errors.As(err, &optErr) {
+		return []IfaceOptionError{optErr}
+	}
+	return nil
+}
+
+func (i *nwIface) processInterfaceOptions(options ...IfaceOption) error {
+	var errs []error
+	for _, opt := range options {
+		if opt == nil {
+			continue
+		}
+		if err := opt(i); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithMaster sets the srcName of the master interface for this interface.
+func WithMaster(name string) IfaceOption {
+	return func(i *nwIface) error {
+		i.master = name
+		return nil
+	}
+}
+
+// WithMacAddress sets the interface MAC address.
+func WithMacAddress(mac net.HardwareAddr) IfaceOption {
+	return func(i *nwIface) error {
+		if mac != nil && len(mac) != 6 && len(mac) != 20 {
+			return IfaceOptionError{Option: "WithMacAddress", Err: fmt.Errorf("invalid hardware address %q", mac)}
+		}
+		i.mac = mac
+		return nil
+	}
+}
+
+// WithIPv4Address sets the IPv4 address of the interface.
+func WithIPv4Address(addr *net.IPNet) IfaceOption {
+	return func(i *nwIface) error {
+		if addr != nil && addr.IP.To4() == nil {
+			return IfaceOptionError{Option: "WithIPv4Address", Err: fmt.Errorf("%s is not an IPv4 address", addr)}
+		}
+		i.address = addr
+		return nil
+	}
+}
+
+// WithIPv6Address sets the IPv6 address of the interface.
+func WithIPv6Address(addr *net.IPNet) IfaceOption {
+	return func(i *nwIface) error {
+		if addr != nil && addr.IP.To4() != nil {
+			return IfaceOptionError{Option: "WithIPv6Address", Err: fmt.Errorf("%s is not an IPv6 address", addr)}
+		}
+		i.addressIPv6 = addr
+		return nil
+	}
+}
+
+// WithIsBridge marks the interface as a bridge that should be created inside
+// the sandbox rather than moved in from the host namespace.
+func WithIsBridge(isBridge bool) IfaceOption {
+	return func(i *nwIface) error {
+		i.bridge = isBridge
+		return nil
+	}
+}
+
+// WithLinkLocalAddresses sets the link-local IP addresses of the interface.
+func WithLinkLocalAddresses(list []*net.IPNet) IfaceOption {
+	return func(i *nwIface) error {
+		i.llAddrs = list
+		return nil
+	}
+}
+
+// RouteSpec describes a route to be installed on an interface once it has
+// been moved into its sandbox and brought up. It covers more than a plain
+// on-link destination: a gateway, a specific routing table, a metric/source
+// hint and a per-route MTU/AdvMSS can all be set, so callers can install
+// default gateways and policy routes directly through osl instead of having
+// to reach around it.
+type RouteSpec struct {
+	// Destination is the route's destination prefix. Required.
+	Destination *net.IPNet
+	// Gateway is the next-hop address, for a gateway route. May be nil for
+	// an on-link route.
+	Gateway net.IP
+	// Source is a source-address hint for traffic using this route.
+	Source net.IP
+	// Scope is the route scope. If zero and Gateway is nil, it defaults to
+	// netlink.SCOPE_LINK to match a plain on-link destination route.
+	Scope netlink.Scope
+	// Protocol identifies who installed the route (e.g. RTPROT_STATIC).
+	Protocol netlink.RouteProtocol
+	// Table is the routing table id the route is installed into. Zero means
+	// the main table.
+	Table int
+	// Priority is the route metric.
+	Priority int
+	// MTU and AdvMSS are optional per-route overrides. Zero leaves the
+	// kernel/interface default in place.
+	MTU    int
+	AdvMSS int
+}
+
+// WithRoutes sets the IP routes of the interface.
+func WithRoutes(routes ...RouteSpec) IfaceOption {
+	return func(i *nwIface) error {
+		for _, rs := range routes {
+			if rs.Destination == nil {
+				return IfaceOptionError{Option: "WithRoutes", Err: fmt.Errorf("route is missing a destination")}
+			}
+		}
+		i.routes = routes
+		return nil
+	}
+}
+
+// WithSRIOV marks the interface as an SR-IOV Virtual Function of the pfName
+// physical function, at index vfIndex. Instead of moving an existing link
+// into the sandbox, AddInterface resolves the VF's current device name via
+// the PF's virtfn symlink and moves that. On Remove, the VF is renamed to a
+// deterministic name and moved back into the namespace at initNsPath rather
+// than the daemon's host namespace, so it can be handed back to whatever
+// owns the PF (e.g. a SR-IOV device plugin) instead of being left visible to
+// the host.
+func WithSRIOV(pfName string, vfIndex int, initNsPath string) IfaceOption {
+	return func(i *nwIface) error {
+		if pfName == "" || vfIndex < 0 || initNsPath == "" {
+			return IfaceOptionError{Option: "WithSRIOV", Err: fmt.Errorf("pfName and initNsPath are required and vfIndex must be non-negative")}
+		}
+		i.sriovPFName = pfName
+		i.sriovVFIndex = vfIndex
+		i.sriovInitNsPath = initNsPath
+		return nil
+	}
+}
+
+// WithVFVlan sets the VLAN to program on the VF's physical function before
+// the VF is moved into the sandbox. It has no effect unless combined with
+// WithSRIOV.
+func WithVFVlan(vlan int) IfaceOption {
+	return func(i *nwIface) error {
+		i.sriovVFVlan = vlan
+		return nil
+	}
+}
+
+// WithMacvlan marks the interface as a macvlan link for the sandbox, created
+// on the host with parent as its parent interface and then moved in, with
+// mode as its macvlan mode. mtu is applied to the child link at creation time; a value
+// of 0 leaves the kernel default in place.
+func WithMacvlan(parent string, mode netlink.MacvlanMode, mtu int) IfaceOption {
+	return func(i *nwIface) error {
+		if parent == "" {
+			return IfaceOptionError{Option: "WithMacvlan", Err: fmt.Errorf("parent interface name is required")}
+		}
+		i.childLinkKind = "macvlan"
+		i.childLinkParent = parent
+		i.macvlanMode = mode
+		i.childLinkMTU = mtu
+		return nil
+	}
+}
+
+// WithMacvtap marks the interface as a macvtap link for the sandbox, created
+// on the host with parent as its parent interface and then moved in, with
+// mode as its macvtap mode. mtu is applied to the child link at creation time; a value
+// of 0 leaves the kernel default in place.
+func WithMacvtap(parent string, mode netlink.MacvtapMode, mtu int) IfaceOption {
+	return func(i *nwIface) error {
+		if parent == "" {
+			return IfaceOptionError{Option: "WithMacvtap", Err: fmt.Errorf("parent interface name is required")}
+		}
+		i.childLinkKind = "macvtap"
+		i.childLinkParent = parent
+		i.macvtapMode = mode
+		i.childLinkMTU = mtu
+		return nil
+	}
+}
+
+// WithIPVlan marks the interface as an ipvlan link for the sandbox, created
+// on the host with parent as its parent interface and then moved in, with
+// mode as its ipvlan mode. mtu is applied to the child link at creation time; a value
+// of 0 leaves the kernel default in place.
+func WithIPVlan(parent string, mode netlink.IPVlanMode, mtu int) IfaceOption {
+	return func(i *nwIface) error {
+		if parent == "" {
+			return IfaceOptionError{Option: "WithIPVlan", Err: fmt.Errorf("parent interface name is required")}
+		}
+		i.childLinkKind = "ipvlan"
+		i.childLinkParent = parent
+		i.ipvlanMode = mode
+		i.childLinkMTU = mtu
+		return nil
+	}
+}
+
+// WithMTU sets the MTU of the interface, applied once it is in its sandbox
+// and before it is brought up.
+func WithMTU(mtu int) IfaceOption {
+	return func(i *nwIface) error {
+		if mtu < 0 {
+			return IfaceOptionError{Option: "WithMTU", Err: fmt.Errorf("mtu must not be negative, got %d", mtu)}
+		}
+		i.mtu = mtu
+		return nil
+	}
+}
+
+// WithTxQLen sets the transmit queue length of the interface.
+func WithTxQLen(txQLen int) IfaceOption {
+	return func(i *nwIface) error {
+		if txQLen < 0 {
+			return IfaceOptionError{Option: "WithTxQLen", Err: fmt.Errorf("txQLen must not be negative, got %d", txQLen)}
+		}
+		i.txQLen = txQLen
+		return nil
+	}
+}
+
+// WithOffloads toggles named hardware offload features on the interface.
+// Names are the kernel's feature names (e.g. "tx-checksum-ip-generic",
+// "tx-tcp-segmentation", "tx-generic-segmentation", "rx-gro"); ethtool's
+// short aliases such as "tso", "gso" and "gro" are not recognised.
+func WithOffloads(offloads map[string]bool) IfaceOption {
+	return func(i *nwIface) error {
+		i.offloads = offloads
+		return nil
+	}
 }
 
 // SrcName returns the name of the interface in the origin network namespace.
@@ -80,11 +403,13 @@ func (i *nwIface) LinkLocalAddresses() []*net.IPNet {
 	return i.llAddrs
 }
 
-// Routes returns IP routes for the interface.
+// Routes returns the destination prefixes of the IP routes for the
+// interface. Callers that need the full route model (gateway, table,
+// metric, ...) should inspect the RouteSpecs passed to WithRoutes instead.
 func (i *nwIface) Routes() []*net.IPNet {
 	routes := make([]*net.IPNet, len(i.routes))
 	for index, route := range i.routes {
-		routes[index] = types.GetIPNetCopy(route)
+		routes[index] = types.GetIPNetCopy(route.Destination)
 	}
 
 	return routes
@@ -92,7 +417,32 @@ func (i *nwIface) Routes() []*net.IPNet {
 
 // Remove an interface from the sandbox by renaming to original name
 // and moving it out of the sandbox.
+//
+// A macvlan/macvtap/ipvlan child link is deleted instead, and an SR-IOV VF
+// is renamed to dev<ifindex> and moved back to its init namespace.
+//
+// Deprecated: use RemoveContext so callers can propagate a tracing context
+// down through the netlink calls this makes.
 func (i *nwIface) Remove() error {
+	return i.RemoveContext(context.TODO())
+}
+
+// RemoveContext is Remove with an OpenTelemetry-traced context.
+func (i *nwIface) RemoveContext(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "osl.Remove", trace.WithAttributes(
+		attribute.String("dstName", i.DstName()),
+	))
+	defer span.End()
+
+	if err := i.remove(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (i *nwIface) remove(ctx context.Context) error {
 	i.ns.Lock()
 	isDefault := i.ns.isDefault
 	nlh := i.ns.nlHandle
@@ -109,6 +459,58 @@ func (i *nwIface) Remove() error {
 		return err
 	}
 
+	// A VF carved out of a SR-IOV physical function has no stable SrcName to
+	// rename back to on the host: restore a name derived from the link's own
+	// ifindex, which is unique, and hand it back to the namespace it was
+	// taken from instead of the daemon's host namespace.
+	if i.sriovPFName != "" {
+		defer i.sriovInitNs.Close()
+
+		vfName := fmt.Sprintf("dev%d", iface.Attrs().Index)
+		if err := nlh.LinkSetName(iface, vfName); err != nil {
+			log.G(context.TODO()).Debugf("LinkSetName failed for VF %s: %v", vfName, err)
+			return err
+		}
+		if err := nlh.LinkSetNsFd(iface, int(i.sriovInitNs)); err != nil {
+			log.G(context.TODO()).Debugf("LinkSetNsFd to init namespace failed for VF %s: %v", vfName, err)
+			return err
+		}
+
+		i.ns.Lock()
+		for index, intf := range i.ns.iFaces {
+			if intf == i {
+				i.ns.iFaces = append(i.ns.iFaces[:index], i.ns.iFaces[index+1:]...)
+				break
+			}
+		}
+		i.ns.Unlock()
+
+		i.ns.checkLoV6()
+
+		return nil
+	}
+
+	// A macvlan/macvtap/ipvlan child link only exists inside the sandbox and
+	// has no host-side counterpart to move back to; delete it instead.
+	if i.childLinkKind != "" {
+		if err := nlh.LinkDel(iface); err != nil {
+			return fmt.Errorf("failed deleting %s %q: %v", i.childLinkKind, i.DstName(), err)
+		}
+
+		i.ns.Lock()
+		for index, intf := range i.ns.iFaces {
+			if intf == i {
+				i.ns.iFaces = append(i.ns.iFaces[:index], i.ns.iFaces[index+1:]...)
+				break
+			}
+		}
+		i.ns.Unlock()
+
+		i.ns.checkLoV6()
+
+		return nil
+	}
+
 	err = nlh.LinkSetName(iface, i.SrcName())
 	if err != nil {
 		log.G(context.TODO()).Debugf("LinkSetName failed for interface %s: %v", i.SrcName(), err)
@@ -179,14 +581,165 @@ func (n *networkNamespace) findDst(srcName string, isBridge bool) string {
 	return ""
 }
 
+// vfNameFromPF resolves the current network interface name of the virtual
+// function at vfIndex belonging to the physical function pfName, by
+// following /sys/class/net/<pfName>/device/virtfnN/net. VF netdev names are
+// assigned by the kernel and are not guaranteed to stay put across driver
+// reloads, so callers that need a stable identity for a VF (e.g. across
+// container restarts) should key off pfName+vfIndex rather than the
+// resolved name.
+func vfNameFromPF(pfName string, vfIndex int) (string, error) {
+	virtfnDir := filepath.Join("/sys/class/net", pfName, "device", fmt.Sprintf("virtfn%d", vfIndex), "net")
+	entries, err := os.ReadDir(virtfnDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve VF netdev under %q: %v", virtfnDir, err)
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no network interface found under %q", virtfnDir)
+	}
+	return entries[0].Name(), nil
+}
+
+// linkSubscribeWithOptions is a seam over netlink.LinkSubscribeWithOptions so
+// tests can drive waitForLinkEvent with synthetic events instead of needing
+// a real netlink socket and namespace permissions.
+var linkSubscribeWithOptions = netlink.LinkSubscribeWithOptions
+
+// waitForLinkEvent subscribes to RTMGRP_LINK events in the sandbox's
+// namespace and blocks until ready reports the awaited condition already
+// holds, a NEWLINK update for ifaceName satisfies match, or timeout elapses.
+// It exists because a link that was just moved with LinkSetNsFd, or just
+// asked to come up, isn't always immediately visible to a subsequent
+// netlink request, especially under load.
+//
+// The subscription is opened, then ready is checked, in that order: opening
+// first means a NEWLINK that fires in the gap is queued on the channel
+// rather than missed, so a condition that was already true by the time we
+// get here is caught immediately instead of blocking for the full timeout.
+//
+// If the subscription itself fails to open (some restricted environments
+// don't allow a monitoring socket), it falls back to a single short sleep so
+// the caller's own retry has a chance to catch up.
+func waitForLinkEvent(nsHandle *netns.NsHandle, ifaceName string, timeout time.Duration, ready func() bool, match func(netlink.LinkUpdate) bool) {
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	defer close(done)
+
+	if err := linkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		Namespace: nsHandle,
+	}); err != nil {
+		log.G(context.TODO()).Debugf("netlink link subscribe for %q failed, falling back to a short sleep: %v", ifaceName, err)
+		time.Sleep(10 * time.Millisecond)
+		return
+	}
+
+	if ready() {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if update.Link.Attrs().Name == ifaceName && match(update) {
+				return
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// AddInterface creates a new interface in the sandbox identified by the
+// network namespace and populates it with the appropriate network
+// information.
+//
+// Deprecated: use AddInterfaceContext so callers can propagate a tracing
+// context down through the netlink calls this makes.
 func (n *networkNamespace) AddInterface(srcName, dstPrefix string, options ...IfaceOption) error {
+	return n.AddInterfaceContext(context.TODO(), srcName, dstPrefix, options...)
+}
+
+// AddInterfaceContext is AddInterface with an OpenTelemetry-traced context.
+func (n *networkNamespace) AddInterfaceContext(ctx context.Context, srcName, dstPrefix string, options ...IfaceOption) error {
 	i := &nwIface{
 		srcName: srcName,
 		dstName: dstPrefix,
 		ns:      n,
 	}
-	i.processInterfaceOptions(options...)
+	n.Lock()
+	nsPath := n.path
+	n.Unlock()
+
+	ctx, span := tracer.Start(ctx, "osl.AddInterface", trace.WithAttributes(
+		attribute.String("srcName", srcName),
+		attribute.String("dstName", dstPrefix),
+		attribute.String("netns.path", nsPath),
+	))
+	defer span.End()
+
+	err := i.processInterfaceOptions(options...)
+	span.SetAttributes(
+		attribute.Bool("bridge", i.bridge),
+		attribute.Bool("has_ipv4", i.address != nil),
+		attribute.Bool("has_ipv6", i.addressIPv6 != nil),
+		attribute.Int("route_count", len(i.routes)),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
 
+	if err := n.addInterface(ctx, i, dstPrefix); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// rollbackAddInterface undoes whatever addInterface's initial switch did to
+// move or create iface, for a caller that fails after that point. It mirrors
+// each branch there in reverse: a created bridge or child link is deleted;
+// an SR-IOV VF is renamed back to a stable name and handed back to its
+// recorded init namespace, closing that namespace handle since nothing else
+// will; and an ordinary moved link is renamed back to its SrcName and moved
+// back to the daemon's own namespace.
+//
+// Failures here are logged rather than returned: the caller already has the
+// original error to report, and this is already best-effort cleanup.
+func rollbackAddInterface(nlh *netlink.Handle, iface netlink.Link, i *nwIface) {
+	switch {
+	case i.bridge, i.childLinkKind != "":
+		if err := nlh.LinkDel(iface); err != nil {
+			log.G(context.TODO()).Errorf("failed to delete %s after add error: %v", i.SrcName(), err)
+		}
+	case i.sriovPFName != "":
+		defer i.sriovInitNs.Close()
+
+		vfName := fmt.Sprintf("dev%d", iface.Attrs().Index)
+		if err := nlh.LinkSetName(iface, vfName); err != nil {
+			log.G(context.TODO()).Errorf("renaming VF %s to %s failed after add error: %v", i.SrcName(), vfName, err)
+		}
+		if err := nlh.LinkSetNsFd(iface, int(i.sriovInitNs)); err != nil {
+			log.G(context.TODO()).Errorf("moving VF %s back to its init namespace failed after add error: %v", i.SrcName(), err)
+		}
+	default:
+		if err := nlh.LinkSetName(iface, i.SrcName()); err != nil {
+			log.G(context.TODO()).Errorf("renaming interface (%s->%s) failed after add error: %v", i.DstName(), i.SrcName(), err)
+		}
+		if err := nlh.LinkSetNsFd(iface, ns.ParseHandlerInt()); err != nil {
+			log.G(context.TODO()).Errorf("moving interface %s to host ns failed after add error: %v", i.SrcName(), err)
+		}
+	}
+}
+
+func (n *networkNamespace) addInterface(ctx context.Context, i *nwIface, dstPrefix string) error {
 	if i.master != "" {
 		i.dstMaster = n.findDst(i.master, true)
 		if i.dstMaster == "" {
@@ -209,9 +762,24 @@ func (n *networkNamespace) AddInterface(srcName, dstPrefix string, options ...If
 	nlhHost := ns.NlHandle()
 	n.Unlock()
 
-	// If it is a bridge interface we have to create the bridge inside
-	// the namespace so don't try to lookup the interface using srcName
-	if i.bridge {
+	// sandboxNs scopes the netlink event subscription used below to wait for
+	// the link to show up, and (for the branches that move a link in) the
+	// LinkSetNsFd target. It stays nil for a default-type sandbox, where the
+	// link never leaves the host/current namespace.
+	var sandboxNs *netns.NsHandle
+	if !isDefault {
+		newNs, err := netns.GetFromPath(path)
+		if err != nil {
+			return fmt.Errorf("failed get network namespace %q: %v", path, err)
+		}
+		defer newNs.Close()
+		sandboxNs = &newNs
+	}
+
+	switch {
+	case i.bridge:
+		// If it is a bridge interface we have to create the bridge inside
+		// the namespace so don't try to lookup the interface using srcName
 		if err := nlh.LinkAdd(&netlink.Bridge{
 			LinkAttrs: netlink.LinkAttrs{
 				Name: i.srcName,
@@ -219,7 +787,103 @@ func (n *networkNamespace) AddInterface(srcName, dstPrefix string, options ...If
 		}); err != nil {
 			return fmt.Errorf("failed to create bridge %q: %v", i.srcName, err)
 		}
-	} else {
+	case i.childLinkKind != "":
+		// The child link only exists inside the sandbox, but IFLA_LINK is
+		// resolved by the kernel in the namespace of the netlink socket that
+		// sends the NEWLINK request. Resolve the parent and create the link
+		// on the host, off the real parent ifindex, then move it into the
+		// sandbox like any other link, instead of creating it directly
+		// through the sandbox-bound handle where that ifindex is either
+		// missing or belongs to an unrelated device.
+		parent, err := nlhHost.LinkByName(i.childLinkParent)
+		if err != nil {
+			return fmt.Errorf("failed to get parent link by name %q: %v", i.childLinkParent, err)
+		}
+
+		attrs := netlink.LinkAttrs{
+			Name:        i.srcName,
+			MTU:         i.childLinkMTU,
+			ParentIndex: parent.Attrs().Index,
+		}
+
+		var link netlink.Link
+		switch i.childLinkKind {
+		case "macvlan":
+			link = &netlink.Macvlan{LinkAttrs: attrs, Mode: i.macvlanMode}
+		case "macvtap":
+			link = &netlink.Macvtap{Macvlan: netlink.Macvlan{LinkAttrs: attrs, Mode: i.macvtapMode}}
+		case "ipvlan":
+			link = &netlink.IPVlan{LinkAttrs: attrs, Mode: i.ipvlanMode}
+		default:
+			return fmt.Errorf("unknown child link kind %q", i.childLinkKind)
+		}
+
+		if err := nlhHost.LinkAdd(link); err != nil {
+			return fmt.Errorf("failed to create %s %q off parent %q: %v", i.childLinkKind, i.srcName, i.childLinkParent, err)
+		}
+
+		if !isDefault {
+			if err := nlhHost.LinkSetNsFd(link, int(*sandboxNs)); err != nil {
+				return fmt.Errorf("failed to set namespace on link %q: %v", i.srcName, err)
+			}
+		}
+	case i.sriovPFName != "":
+		// The caller only knows the PF and VF index; resolve the VF's
+		// current netdev name and treat it as the source interface from
+		// here on.
+		vfName, err := vfNameFromPF(i.sriovPFName, i.sriovVFIndex)
+		if err != nil {
+			return fmt.Errorf("failed to resolve VF %d of PF %q: %v", i.sriovVFIndex, i.sriovPFName, err)
+		}
+		i.srcName = vfName
+
+		pfLink, err := nlhHost.LinkByName(i.sriovPFName)
+		if err != nil {
+			return fmt.Errorf("failed to get PF link by name %q: %v", i.sriovPFName, err)
+		}
+		if i.mac != nil {
+			if err := nlhHost.LinkSetVfHardwareAddr(pfLink, i.sriovVFIndex, i.mac); err != nil {
+				return fmt.Errorf("failed to set VF %d hardware address on PF %q: %v", i.sriovVFIndex, i.sriovPFName, err)
+			}
+		}
+		if i.sriovVFVlan != 0 {
+			if err := nlhHost.LinkSetVfVlan(pfLink, i.sriovVFIndex, i.sriovVFVlan); err != nil {
+				return fmt.Errorf("failed to set VF %d VLAN on PF %q: %v", i.sriovVFIndex, i.sriovPFName, err)
+			}
+		}
+
+		initNs, err := netns.GetFromPath(i.sriovInitNsPath)
+		if err != nil {
+			return fmt.Errorf("failed to get init network namespace %q: %v", i.sriovInitNsPath, err)
+		}
+		i.sriovInitNs = initNs
+
+		// i.sriovInitNs is otherwise only closed by remove(), once the VF is
+		// handed back to it. If we bail out below before that handle is
+		// handed off, close it ourselves so it isn't leaked; this interface
+		// never finishes setting up, so nothing else will get the chance to.
+		closeInitNs := true
+		defer func() {
+			if closeInitNs {
+				i.sriovInitNs.Close()
+			}
+		}()
+
+		vfIface, err := nlhHost.LinkByName(vfName)
+		if err != nil {
+			return fmt.Errorf("failed to get link by name %q: %v", vfName, err)
+		}
+		if err := nlhHost.LinkSetDown(vfIface); err != nil {
+			return fmt.Errorf("failed to set VF link %q down: %v", vfName, err)
+		}
+
+		if !isDefault {
+			if err := nlhHost.LinkSetNsFd(vfIface, int(*sandboxNs)); err != nil {
+				return fmt.Errorf("failed to set namespace on link %q: %v", vfName, err)
+			}
+		}
+		closeInitNs = false
+	default:
 		// Find the network interface identified by the SrcName attribute.
 		iface, err := nlhHost.LinkByName(i.srcName)
 		if err != nil {
@@ -230,56 +894,102 @@ func (n *networkNamespace) AddInterface(srcName, dstPrefix string, options ...If
 		// namespace only if the namespace is not a default
 		// type
 		if !isDefault {
-			newNs, err := netns.GetFromPath(path)
-			if err != nil {
-				return fmt.Errorf("failed get network namespace %q: %v", path, err)
-			}
-			defer newNs.Close()
-			if err := nlhHost.LinkSetNsFd(iface, int(newNs)); err != nil {
+			if err := nlhHost.LinkSetNsFd(iface, int(*sandboxNs)); err != nil {
 				return fmt.Errorf("failed to set namespace on link %q: %v", i.srcName, err)
 			}
 		}
 	}
 
-	// Find the network interface identified by the SrcName attribute.
+	// Find the network interface identified by the SrcName attribute. It
+	// may not be visible to this lookup immediately after being moved with
+	// LinkSetNsFd, so give it one bounded wait on a link-event subscription
+	// before giving up.
+	_, lookupSpan := tracer.Start(ctx, "osl.linkByName")
 	iface, err := nlh.LinkByName(i.srcName)
 	if err != nil {
+		waitForLinkEvent(sandboxNs, i.srcName, linkWaitTimeout,
+			func() bool {
+				iface, err = nlh.LinkByName(i.srcName)
+				return err == nil
+			},
+			func(u netlink.LinkUpdate) bool {
+				return u.Header.Type == unix.RTM_NEWLINK
+			},
+		)
+		if err != nil {
+			iface, err = nlh.LinkByName(i.srcName)
+		}
+	}
+	if err != nil {
+		lookupSpan.RecordError(err)
+		lookupSpan.SetStatus(codes.Error, err.Error())
+		lookupSpan.End()
+		if i.sriovPFName != "" {
+			// We moved the VF in but can't find it to roll the move back by
+			// name; at least don't leak the init-namespace handle, since
+			// nothing else will close it for an interface that never made
+			// it into n.iFaces.
+			i.sriovInitNs.Close()
+		}
 		return fmt.Errorf("failed to get link by name %q: %v", i.srcName, err)
 	}
+	lookupSpan.End()
 
 	// Down the interface before configuring
 	if err := nlh.LinkSetDown(iface); err != nil {
+		rollbackAddInterface(nlh, iface, i)
 		return fmt.Errorf("failed to set link down: %v", err)
 	}
 
+	origMTU := iface.Attrs().MTU
+
 	// Configure the interface now this is moved in the proper namespace.
-	if err := configureInterface(nlh, iface, i); err != nil {
-		// If configuring the device fails move it back to the host namespace
-		// and change the name back to the source name. This allows the caller
-		// to properly cleanup the interface. Its important especially for
-		// interfaces with global attributes, ex: vni id for vxlan interfaces.
-		if nerr := nlh.LinkSetName(iface, i.SrcName()); nerr != nil {
-			log.G(context.TODO()).Errorf("renaming interface (%s->%s) failed, %v after config error %v", i.DstName(), i.SrcName(), nerr, err)
-		}
-		if nerr := nlh.LinkSetNsFd(iface, ns.ParseHandlerInt()); nerr != nil {
-			log.G(context.TODO()).Errorf("moving interface %s to host ns failed, %v, after config error %v", i.SrcName(), nerr, err)
+	if err := configureInterface(ctx, nlh, iface, i); err != nil {
+		// If configuring the device fails, undo whatever the initial switch
+		// above did to it. This allows the caller to properly cleanup the
+		// interface. Its important especially for interfaces with global
+		// attributes, ex: vni id for vxlan interfaces.
+		if i.mtu != 0 {
+			if nerr := nlh.LinkSetMTU(iface, origMTU); nerr != nil {
+				log.G(context.TODO()).Errorf("restoring MTU to %d for interface %s failed, %v after config error %v", origMTU, i.SrcName(), nerr, err)
+			}
 		}
+		rollbackAddInterface(nlh, iface, i)
 		return err
 	}
 
-	// Up the interface.
+	// Up the interface. Rather than blindly sleeping between retries, wait
+	// on a link-event subscription for the NEWLINK/IFF_UP event that tells
+	// us the change actually took effect.
+	_, upSpan := tracer.Start(ctx, "osl.linkSetUp")
 	cnt := 0
 	for err = nlh.LinkSetUp(iface); err != nil && cnt < 3; cnt++ {
 		log.G(context.TODO()).Debugf("retrying link setup because of: %v", err)
-		time.Sleep(10 * time.Millisecond)
+		name := iface.Attrs().Name
+		waitForLinkEvent(sandboxNs, name, linkWaitTimeout,
+			func() bool {
+				cur, lerr := nlh.LinkByName(name)
+				return lerr == nil && cur.Attrs().Flags&net.FlagUp != 0
+			},
+			func(u netlink.LinkUpdate) bool {
+				return u.Header.Type == unix.RTM_NEWLINK && u.IfInfomsg.Flags&unix.IFF_UP != 0
+			},
+		)
 		err = nlh.LinkSetUp(iface)
 	}
+	upSpan.SetAttributes(attribute.Int("retry_count", cnt))
 	if err != nil {
+		upSpan.RecordError(err)
+		upSpan.SetStatus(codes.Error, err.Error())
+		upSpan.End()
+		rollbackAddInterface(nlh, iface, i)
 		return fmt.Errorf("failed to set link up: %v", err)
 	}
+	upSpan.End()
 
 	// Set the routes on the interface. This can only be done when the interface is up.
-	if err := setInterfaceRoutes(nlh, iface, i); err != nil {
+	if err := setInterfaceRoutes(ctx, nlh, iface, i); err != nil {
+		rollbackAddInterface(nlh, iface, i)
 		return fmt.Errorf("error setting interface %q routes to %q: %v", iface.Attrs().Name, i.Routes(), err)
 	}
 
@@ -292,29 +1002,39 @@ func (n *networkNamespace) AddInterface(srcName, dstPrefix string, options ...If
 	return nil
 }
 
-func configureInterface(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func configureInterface(ctx context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	ifaceName := iface.Attrs().Name
 	ifaceConfigurators := []struct {
-		Fn         func(*netlink.Handle, netlink.Link, *nwIface) error
+		Fn         func(context.Context, *netlink.Handle, netlink.Link, *nwIface) error
+		Name       string
 		ErrMessage string
 	}{
-		{setInterfaceName, fmt.Sprintf("error renaming interface %q to %q", ifaceName, i.DstName())},
-		{setInterfaceMAC, fmt.Sprintf("error setting interface %q MAC to %q", ifaceName, i.MacAddress())},
-		{setInterfaceIP, fmt.Sprintf("error setting interface %q IP to %v", ifaceName, i.Address())},
-		{setInterfaceIPv6, fmt.Sprintf("error setting interface %q IPv6 to %v", ifaceName, i.AddressIPv6())},
-		{setInterfaceMaster, fmt.Sprintf("error setting interface %q master to %q", ifaceName, i.DstMaster())},
-		{setInterfaceLinkLocalIPs, fmt.Sprintf("error setting interface %q link local IPs to %v", ifaceName, i.LinkLocalAddresses())},
+		{setInterfaceName, "setInterfaceName", fmt.Sprintf("error renaming interface %q to %q", ifaceName, i.DstName())},
+		{setInterfaceMAC, "setInterfaceMAC", fmt.Sprintf("error setting interface %q MAC to %q", ifaceName, i.MacAddress())},
+		{setInterfaceIP, "setInterfaceIP", fmt.Sprintf("error setting interface %q IP to %v", ifaceName, i.Address())},
+		{setInterfaceIPv6, "setInterfaceIPv6", fmt.Sprintf("error setting interface %q IPv6 to %v", ifaceName, i.AddressIPv6())},
+		{setInterfaceMaster, "setInterfaceMaster", fmt.Sprintf("error setting interface %q master to %q", ifaceName, i.DstMaster())},
+		{setInterfaceLinkLocalIPs, "setInterfaceLinkLocalIPs", fmt.Sprintf("error setting interface %q link local IPs to %v", ifaceName, i.LinkLocalAddresses())},
+		{setInterfaceMTU, "setInterfaceMTU", fmt.Sprintf("error setting interface %q MTU to %d", ifaceName, i.mtu)},
+		{setInterfaceTxQLen, "setInterfaceTxQLen", fmt.Sprintf("error setting interface %q txqueuelen to %d", ifaceName, i.txQLen)},
+		{setInterfaceOffloads, "setInterfaceOffloads", fmt.Sprintf("error setting interface %q offloads to %v", ifaceName, i.offloads)},
 	}
 
+	var errs []error
 	for _, config := range ifaceConfigurators {
-		if err := config.Fn(nlh, iface, i); err != nil {
-			return fmt.Errorf("%s: %v", config.ErrMessage, err)
+		configCtx, configSpan := tracer.Start(ctx, "osl."+config.Name)
+		err := config.Fn(configCtx, nlh, iface, i)
+		if err != nil {
+			configSpan.RecordError(err)
+			configSpan.SetStatus(codes.Error, err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", config.ErrMessage, err))
 		}
+		configSpan.End()
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func setInterfaceMaster(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func setInterfaceMaster(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	if i.DstMaster() == "" {
 		return nil
 	}
@@ -324,29 +1044,29 @@ func setInterfaceMaster(nlh *netlink.Handle, iface netlink.Link, i *nwIface) err
 	})
 }
 
-func setInterfaceMAC(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func setInterfaceMAC(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	if i.MacAddress() == nil {
 		return nil
 	}
 	return nlh.LinkSetHardwareAddr(iface, i.MacAddress())
 }
 
-func setInterfaceIP(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func setInterfaceIP(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	if i.Address() == nil {
 		return nil
 	}
-	if err := checkRouteConflict(nlh, i.Address(), netlink.FAMILY_V4); err != nil {
+	if err := checkRouteConflict(nlh, i.Address(), netlink.FAMILY_V4, 0); err != nil {
 		return err
 	}
 	ipAddr := &netlink.Addr{IPNet: i.Address(), Label: ""}
 	return nlh.AddrAdd(iface, ipAddr)
 }
 
-func setInterfaceIPv6(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func setInterfaceIPv6(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	if i.AddressIPv6() == nil {
 		return nil
 	}
-	if err := checkRouteConflict(nlh, i.AddressIPv6(), netlink.FAMILY_V6); err != nil {
+	if err := checkRouteConflict(nlh, i.AddressIPv6(), netlink.FAMILY_V6, 0); err != nil {
 		return err
 	}
 	if err := setIPv6(i.ns.path, i.DstName(), true); err != nil {
@@ -356,7 +1076,7 @@ func setInterfaceIPv6(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error
 	return nlh.AddrAdd(iface, ipAddr)
 }
 
-func setInterfaceLinkLocalIPs(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func setInterfaceLinkLocalIPs(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	for _, llIP := range i.LinkLocalAddresses() {
 		ipAddr := &netlink.Addr{IPNet: llIP}
 		if err := nlh.AddrAdd(iface, ipAddr); err != nil {
@@ -366,16 +1086,76 @@ func setInterfaceLinkLocalIPs(nlh *netlink.Handle, iface netlink.Link, i *nwIfac
 	return nil
 }
 
-func setInterfaceName(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+func setInterfaceMTU(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+	if i.mtu == 0 {
+		return nil
+	}
+	return nlh.LinkSetMTU(iface, i.mtu)
+}
+
+func setInterfaceTxQLen(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
+	if i.txQLen == 0 {
+		return nil
+	}
+	return nlh.LinkSetTxQLen(iface, i.txQLen)
+}
+
+func setInterfaceOffloads(_ context.Context, _ *netlink.Handle, iface netlink.Link, i *nwIface) error {
+	if len(i.offloads) == 0 {
+		return nil
+	}
+	// iface.Attrs().Name still holds the pre-rename SrcName: LinkSetName (run
+	// by setInterfaceName, earlier in the configurator list) only issues the
+	// netlink rename, it doesn't update the Link's cached attributes. Name
+	// resolution for the ethtool ioctl isn't index-bound like the netlink
+	// calls above it, so it needs the actual post-rename name.
+	return setInterfaceOffloadsViaEthtool(i.ns.path, i.DstName(), i.offloads)
+}
+
+func setInterfaceName(_ context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
 	return nlh.LinkSetName(iface, i.DstName())
 }
 
-func setInterfaceRoutes(nlh *netlink.Handle, iface netlink.Link, i *nwIface) error {
-	for _, route := range i.Routes() {
+func setInterfaceRoutes(ctx context.Context, nlh *netlink.Handle, iface netlink.Link, i *nwIface) (retErr error) {
+	_, span := tracer.Start(ctx, "osl.setInterfaceRoutes", trace.WithAttributes(attribute.Int("route_count", len(i.routes))))
+	defer func() {
+		if retErr != nil {
+			span.RecordError(retErr)
+			span.SetStatus(codes.Error, retErr.Error())
+		}
+		span.End()
+	}()
+
+	for _, rs := range i.routes {
+		scope := rs.Scope
+		if scope == 0 && rs.Gateway == nil {
+			// Preserve the historical default for a plain destination-only
+			// route: an on-link route rather than a gateway-less universe
+			// scope route, which the kernel would otherwise reject.
+			scope = netlink.SCOPE_LINK
+		}
+
+		if rs.Destination != nil {
+			family := netlink.FAMILY_V4
+			if rs.Destination.IP.To4() == nil {
+				family = netlink.FAMILY_V6
+			}
+			if err := checkRouteConflict(nlh, rs.Destination, family, rs.Table); err != nil {
+				return err
+			}
+		}
+
 		err := nlh.RouteAdd(&netlink.Route{
-			Scope:     netlink.SCOPE_LINK,
 			LinkIndex: iface.Attrs().Index,
-			Dst:       route,
+			Dst:       rs.Destination,
+			Gw:        rs.Gateway,
+			Src:       rs.Source,
+			Scope:     scope,
+			Protocol:  rs.Protocol,
+			Table:     rs.Table,
+			Priority:  rs.Priority,
+			MTU:       rs.MTU,
+			AdvMSS:    rs.AdvMSS,
 		})
 		if err != nil {
 			return err
@@ -384,12 +1164,34 @@ func setInterfaceRoutes(nlh *netlink.Handle, iface netlink.Link, i *nwIface) err
 	return nil
 }
 
-func checkRouteConflict(nlh *netlink.Handle, address *net.IPNet, family int) error {
-	routes, err := nlh.RouteList(nil, family)
+// checkRouteConflict rejects programming address on the interface if it
+// conflicts with an existing route in the same table. Routes in other
+// routing tables are allowed to overlap, since they only become effective
+// for traffic that is policy-routed into that table.
+func checkRouteConflict(nlh *netlink.Handle, address *net.IPNet, family, table int) error {
+	// table == 0 is our "caller didn't specify a table" value (see
+	// RouteSpec.Table), but the kernel always resolves a route's table to
+	// RT_TABLE_MAIN (254) on dump, never leaving it at 0. Normalize so the
+	// common no-table-specified case is actually compared against main-table
+	// routes instead of silently matching nothing.
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+
+	// RouteList only reports main-table routes; filter on the table instead
+	// so routes in the other tables are seen too.
+	routes, err := nlh.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
 	if err != nil {
 		return err
 	}
 	for _, route := range routes {
+		routeTable := route.Table
+		if routeTable == 0 {
+			routeTable = unix.RT_TABLE_MAIN
+		}
+		if routeTable != table {
+			continue
+		}
 		if route.Dst != nil {
 			if route.Dst.Contains(address.IP) || address.Contains(route.Dst.IP) {
 				return fmt.Errorf("cannot program address %v in sandbox interface because it conflicts with existing route %s",
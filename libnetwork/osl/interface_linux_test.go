@@ -0,0 +1,270 @@
+package osl
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestProcessInterfaceOptionsAggregatesErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		options []IfaceOption
+		wantErr []string
+	}{
+		{
+			name: "all valid",
+			options: []IfaceOption{
+				WithMaster("eth0"),
+				WithMTU(1500),
+				WithTxQLen(1000),
+			},
+		},
+		{
+			name: "single invalid option",
+			options: []IfaceOption{
+				WithMaster("eth0"),
+				WithMTU(-1),
+			},
+			wantErr: []string{"WithMTU"},
+		},
+		{
+			name: "multiple invalid options all reported",
+			options: []IfaceOption{
+				WithMTU(-1),
+				WithTxQLen(-1),
+				WithMacAddress(net.HardwareAddr{0x01, 0x02}),
+			},
+			wantErr: []string{"WithMTU", "WithTxQLen", "WithMacAddress"},
+		},
+		{
+			name: "nil options are skipped",
+			options: []IfaceOption{
+				nil,
+				WithMaster("eth0"),
+				nil,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := &nwIface{}
+			err := i.processInterfaceOptions(tc.options...)
+
+			optErrs := AsIfaceOptionErrors(err)
+			if len(optErrs) != len(tc.wantErr) {
+				t.Fatalf("got %d option errors (%v), want %d (%v)", len(optErrs), optErrs, len(tc.wantErr), tc.wantErr)
+			}
+			for idx, want := range tc.wantErr {
+				if optErrs[idx].Option != want {
+					t.Errorf("option error %d = %q, want %q", idx, optErrs[idx].Option, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAsIfaceOptionErrorsNil(t *testing.T) {
+	if errs := AsIfaceOptionErrors(nil); errs != nil {
+		t.Errorf("AsIfaceOptionErrors(nil) = %v, want nil", errs)
+	}
+}
+
+func TestAsIfaceOptionErrorsIgnoresUnrelatedErrors(t *testing.T) {
+	err := errors.New("some unrelated failure")
+	if errs := AsIfaceOptionErrors(err); errs != nil {
+		t.Errorf("AsIfaceOptionErrors(%v) = %v, want nil", err, errs)
+	}
+}
+
+func TestIfaceOptionErrorUnwrap(t *testing.T) {
+	inner := errors.New("bad value")
+	optErr := IfaceOptionError{Option: "WithMTU", Err: inner}
+
+	if !errors.Is(optErr, inner) {
+		t.Errorf("errors.Is(%v, %v) = false, want true", optErr, inner)
+	}
+	if got := optErr.Error(); got != "WithMTU: bad value" {
+		t.Errorf("Error() = %q, want %q", got, "WithMTU: bad value")
+	}
+}
+
+// fakeLinkSubscribe returns a linkSubscribeWithOptions stand-in that
+// succeeds and forwards whatever is sent on events to the subscriber,
+// so waitForLinkEvent can be driven deterministically without a real
+// netlink socket or namespace permissions.
+func fakeLinkSubscribe(events <-chan netlink.LinkUpdate) func(chan<- netlink.LinkUpdate, <-chan struct{}, netlink.LinkSubscribeOptions) error {
+	return func(ch chan<- netlink.LinkUpdate, done <-chan struct{}, _ netlink.LinkSubscribeOptions) error {
+		go func() {
+			for events != nil {
+				select {
+				case ev, ok := <-events:
+					if !ok {
+						return
+					}
+					select {
+					case ch <- ev:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		return nil
+	}
+}
+
+func withFakeLinkSubscribe(t *testing.T, events <-chan netlink.LinkUpdate) {
+	t.Helper()
+	orig := linkSubscribeWithOptions
+	linkSubscribeWithOptions = fakeLinkSubscribe(events)
+	t.Cleanup(func() { linkSubscribeWithOptions = orig })
+}
+
+func TestWaitForLinkEventReadyImmediately(t *testing.T) {
+	withFakeLinkSubscribe(t, nil)
+
+	matchCalled := false
+	start := time.Now()
+	waitForLinkEvent(nil, "eth0", time.Second,
+		func() bool { return true },
+		func(netlink.LinkUpdate) bool { matchCalled = true; return true },
+	)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("waitForLinkEvent took %v, want a near-instant return when ready() already reports done", elapsed)
+	}
+	if matchCalled {
+		t.Errorf("match was invoked, want it skipped once ready() already reports done")
+	}
+}
+
+func TestWaitForLinkEventReturnsOnMatchingUpdate(t *testing.T) {
+	events := make(chan netlink.LinkUpdate, 2)
+	withFakeLinkSubscribe(t, events)
+
+	other := netlink.LinkUpdate{Link: &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "other0"}}}
+	other.Header.Type = unix.RTM_NEWLINK
+	target := netlink.LinkUpdate{Link: &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}}
+	target.Header.Type = unix.RTM_NEWLINK
+
+	events <- other
+	events <- target
+
+	done := make(chan struct{})
+	go func() {
+		waitForLinkEvent(nil, "eth0", 2*time.Second,
+			func() bool { return false },
+			func(u netlink.LinkUpdate) bool { return u.Header.Type == unix.RTM_NEWLINK },
+		)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForLinkEvent did not return after its matching update arrived")
+	}
+}
+
+func TestWaitForLinkEventTimesOut(t *testing.T) {
+	withFakeLinkSubscribe(t, nil)
+
+	timeout := 50 * time.Millisecond
+	start := time.Now()
+	waitForLinkEvent(nil, "eth0", timeout,
+		func() bool { return false },
+		func(netlink.LinkUpdate) bool { return false },
+	)
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("waitForLinkEvent returned after %v, want at least the %v timeout", elapsed, timeout)
+	}
+}
+
+func TestWaitForLinkEventFallsBackWhenSubscribeFails(t *testing.T) {
+	orig := linkSubscribeWithOptions
+	linkSubscribeWithOptions = func(chan<- netlink.LinkUpdate, <-chan struct{}, netlink.LinkSubscribeOptions) error {
+		return errors.New("subscribe not permitted")
+	}
+	t.Cleanup(func() { linkSubscribeWithOptions = orig })
+
+	readyCalled := false
+	start := time.Now()
+	waitForLinkEvent(nil, "eth0", time.Second,
+		func() bool { readyCalled = true; return true },
+		func(netlink.LinkUpdate) bool { return true },
+	)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("fallback sleep took %v, want a short bounded sleep", elapsed)
+	}
+	if readyCalled {
+		t.Errorf("ready was consulted, want it skipped when the subscription itself fails to open")
+	}
+}
+
+// TestCheckRouteConflictDefaultTable covers the common case of a caller
+// that doesn't set an explicit RouteSpec.Table: such routes, and the routes
+// nlh.RouteList reports for them, both need to be treated as the main table
+// (254) for the conflict check to do anything at all.
+func TestCheckRouteConflictDefaultTable(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("skipping test that requires root to create a network namespace")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNs, err := netns.Get()
+	if err != nil {
+		t.Fatalf("failed to get current namespace: %v", err)
+	}
+	defer origNs.Close()
+
+	newNs, err := netns.New()
+	if err != nil {
+		t.Fatalf("failed to create test namespace: %v", err)
+	}
+	defer newNs.Close()
+	defer netns.Set(origNs)
+
+	nlh, err := netlink.NewHandle()
+	if err != nil {
+		t.Fatalf("failed to create netlink handle: %v", err)
+	}
+	defer nlh.Close()
+
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "osltest0"}}
+	if err := nlh.LinkAdd(dummy); err != nil {
+		t.Fatalf("failed to create test link: %v", err)
+	}
+	if err := nlh.LinkSetUp(dummy); err != nil {
+		t.Fatalf("failed to bring up test link: %v", err)
+	}
+
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP("192.0.2.1"), Mask: net.CIDRMask(24, 32)}}
+	if err := nlh.AddrAdd(dummy, addr); err != nil {
+		t.Fatalf("failed to add address: %v", err)
+	}
+
+	// Adding the address installs a main-table on-link route for
+	// 192.0.2.0/24, with Table resolved by the kernel to RT_TABLE_MAIN (254)
+	// rather than left at 0.
+	conflicting := &net.IPNet{IP: net.ParseIP("192.0.2.128"), Mask: net.CIDRMask(25, 32)}
+	if err := checkRouteConflict(nlh, conflicting, netlink.FAMILY_V4, 0); err == nil {
+		t.Errorf("checkRouteConflict(table=0) = nil, want a conflict error against the main-table route installed by AddrAdd")
+	}
+
+	// A route scoped to a different, explicit table must not be flagged.
+	if err := checkRouteConflict(nlh, conflicting, netlink.FAMILY_V4, 100); err != nil {
+		t.Errorf("checkRouteConflict(table=100) = %v, want nil: the conflicting route is in the main table, not 100", err)
+	}
+}